@@ -0,0 +1,75 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2021 Tobias Leonhard Joschka Peslalz
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package messaging hides the concrete message-queue client behind a small
+// interface, so services can be deployed against different broker
+// implementations (RabbitMQ, NATS JetStream, ...) without changing their
+// business logic.
+package messaging
+
+// Message is a single inbound delivery a Broker hands to a Subscribe handler.
+// Ack/Nack forward to the originating delivery, whatever the underlying
+// broker implementation is.
+type Message struct {
+	Body    []byte
+	Headers map[string]interface{}
+	// Ack confirms the message was processed successfully
+	Ack func() error
+	// Nack rejects the message as unprocessable. The broker decides whether
+	// to redeliver it or route it to a dead-letter destination, based on how
+	// many times it has already been redelivered
+	Nack func() error
+}
+
+// Handler processes a single inbound Message
+type Handler func(Message)
+
+// Broker abstracts the publish/subscribe operations a service needs from its
+// message queue. Concrete implementations own connection setup, topology
+// declaration and redelivery/dead-lettering semantics for their backend.
+type Broker interface {
+	// Subscribe declares queueName, binds it to topic/routingKey, and
+	// invokes handler for every message delivered on it until the broker is
+	// closed
+	Subscribe(topic string, routingKey string, queueName string, handler Handler) error
+	// Publish sends payload to topic under routingKey and, where the backend
+	// supports it, waits for the broker to confirm the message was accepted
+	Publish(topic string, routingKey string, payload []byte) error
+	// Pause stops delivering messages to the handler passed to Subscribe
+	// without losing the subscription, so a caller can apply backpressure
+	// (e.g. a tripped circuit breaker) without losing its place in the queue
+	Pause() error
+	// Resume restarts delivery after Pause
+	Resume() error
+	// Close releases the underlying connection
+	Close() error
+}
+
+// QueueInspector is implemented by Broker backends that can report a
+// point-in-time queue depth, the signal KEDA's rabbitmq scaler autoscales
+// on. Not every backend can: NATS JetStream, for example, exposes depth via
+// its own stream API instead of a queue abstraction.
+type QueueInspector interface {
+	QueueDepth(queueName string) (int, error)
+}
@@ -0,0 +1,157 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2021 Tobias Leonhard Joschka Peslalz
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package messaging
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NatsBroker is a Broker backed by NATS JetStream, for deployments that
+// don't run RabbitMQ. Topics map to JetStream streams and routingKey maps to
+// the subject messages are published/consumed under.
+type NatsBroker struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+	sub  *nats.Subscription
+
+	dlqSubject      string
+	maxRedeliveries int
+
+	// subject, queueName and handler are kept around so Resume can
+	// re-subscribe after Pause tore the subscription down
+	subject   string
+	queueName string
+	handler   Handler
+}
+
+// NewNatsBroker connects to a NATS server and opens a JetStream context.
+// dlqSubject is where a message is republished once it has been redelivered
+// maxRedeliveries times, mirroring RabbitBroker's dead-letter queue.
+func NewNatsBroker(url string, dlqSubject string, maxRedeliveries int) (*NatsBroker, error) {
+	conn, err := nats.Connect(url, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NatsBroker{conn: conn, js: js, dlqSubject: dlqSubject, maxRedeliveries: maxRedeliveries}, nil
+}
+
+// Subscribe ensures a stream backing topic exists and starts a durable
+// JetStream consumer bound to queueName/routingKey, delivering messages to
+// handler. Redelivery is bounded by the consumer's MaxDeliver, set on the
+// subscription in startConsuming (MaxDeliver is a consumer setting, not a
+// stream one, so it can't be configured here on the stream); dead-lettering
+// is handled by this broker republishing onto dlqSubject once that bound is
+// hit, since JetStream has no dead-letter-exchange equivalent of its own.
+func (broker *NatsBroker) Subscribe(topic string, routingKey string, queueName string, handler Handler) error {
+	_, err := broker.js.AddStream(&nats.StreamConfig{
+		Name:     topic,
+		Subjects: []string{topic + ".>"},
+	})
+	if err != nil && err != nats.ErrStreamNameAlreadyInUse {
+		return err
+	}
+
+	broker.subject = topic + "." + routingKey
+	broker.queueName = queueName
+	broker.handler = handler
+	return broker.startConsuming()
+}
+
+// startConsuming opens a fresh queue subscription on broker.subject and
+// dispatches every message to broker.handler until the subscription is torn
+// down again. The consumer's MaxDeliver bounds how many times JetStream will
+// redeliver a message; once a handler Nacks on what would be the last
+// attempt, the message is republished onto broker.dlqSubject instead of
+// being handed back to JetStream, so it lands somewhere inspectable instead
+// of silently stopping redelivery.
+func (broker *NatsBroker) startConsuming() error {
+	sub, err := broker.js.QueueSubscribe(broker.subject, broker.queueName, func(msg *nats.Msg) {
+		meta, _ := msg.Metadata()
+		var delivered int64
+		if meta != nil {
+			delivered = int64(meta.NumDelivered)
+		}
+		broker.handler(Message{
+			Body:    msg.Data,
+			Headers: map[string]interface{}{"x-death": delivered - 1},
+			Ack:     msg.Ack,
+			Nack: func() error {
+				if delivered > int64(broker.maxRedeliveries) {
+					return broker.deadLetter(msg)
+				}
+				return msg.Nak()
+			},
+		})
+	}, nats.Durable(broker.queueName), nats.ManualAck(), nats.MaxDeliver(broker.maxRedeliveries+1))
+	if err != nil {
+		return err
+	}
+	broker.sub = sub
+	return nil
+}
+
+// deadLetter republishes msg onto broker.dlqSubject and acks the original so
+// JetStream stops redelivering it, mirroring RabbitBroker's dead-letter
+// exchange bound to a DLQ
+func (broker *NatsBroker) deadLetter(msg *nats.Msg) error {
+	if _, err := broker.js.Publish(broker.dlqSubject, msg.Data); err != nil {
+		return err
+	}
+	return msg.Ack()
+}
+
+// Pause stops delivering messages by tearing down the subscription; the
+// durable consumer on the server keeps its position so Resume picks up
+// where it left off
+func (broker *NatsBroker) Pause() error {
+	return broker.sub.Unsubscribe()
+}
+
+// Resume re-opens the subscription torn down by Pause
+func (broker *NatsBroker) Resume() error {
+	return broker.startConsuming()
+}
+
+// Publish sends payload to topic.routingKey and waits for the JetStream
+// acknowledgement that it was persisted
+func (broker *NatsBroker) Publish(topic string, routingKey string, payload []byte) error {
+	_, err := broker.js.Publish(topic+"."+routingKey, payload)
+	if err != nil {
+		return fmt.Errorf("nats publish: %w", err)
+	}
+	return nil
+}
+
+// Close drains and closes the underlying NATS connection
+func (broker *NatsBroker) Close() error {
+	return broker.conn.Drain()
+}
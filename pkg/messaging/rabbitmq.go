@@ -0,0 +1,505 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2021 Tobias Leonhard Joschka Peslalz
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package messaging
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	loggingUtil "github.com/Tobias-Pe/Microservices-Errorhandling/pkg/log"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// confirmTimeout is how long Publish waits for the broker to confirm a
+// message before treating the publish as failed
+const confirmTimeout = 5 * time.Second
+
+// retryCountHeader is the header this broker stamps onto a message every
+// time it retries it, since a plain Nack(requeue=true) redelivers the
+// message unchanged and RabbitMQ only ever appends "x-death" once a message
+// has already passed through a dead-letter exchange - it never fires for a
+// same-queue requeue, so it can't bound redelivery on its own
+const retryCountHeader = "x-retry-count"
+
+// consumerTag identifies this service's consumer so Pause/Resume can
+// cancel and restart the same subscription
+const consumerTag = "payment"
+
+// reconnectBaseDelay and reconnectMaxBackoff bound the capped exponential
+// backoff the supervisor uses while redialing after a dropped connection
+const (
+	reconnectBaseDelay  = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+var logger = loggingUtil.InitLogger()
+
+// RabbitBroker is a Broker backed by RabbitMQ via amqp091-go - the only AMQP
+// client in this tree, since payment is currently the only service that
+// talks to a broker at all; the deprecated streadway/amqp does not appear
+// anywhere else here. It declares a topic exchange per Subscribe call, a
+// durable queue bound to it, and a matching dead-letter exchange/queue so
+// poison messages stop retrying forever and land somewhere inspectable. A
+// supervisor goroutine watches the connection and transparently redials,
+// re-declares this topology and resumes consuming if the broker ever drops
+// it.
+type RabbitBroker struct {
+	// mu guards conn/channel, which are swapped out by the supervisor
+	// whenever it redials
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+
+	// stop is closed by Close, so superviseConnection can tell a deliberate
+	// shutdown apart from a dropped connection and stop redialing instead of
+	// immediately reconnecting to the broker it was just told to leave
+	stop chan struct{}
+
+	url             string
+	dlqName         string
+	maxRedeliveries int64
+
+	// topic, routingKey, queueName and handler are kept around so the
+	// supervisor can re-declare topology and resume consuming after a
+	// reconnect, and so Resume can restart consumption after Pause
+	topic      string
+	routingKey string
+	queueName  string
+	handler    Handler
+
+	// blockedMu/blocked/unblocked implement the gate Publish waits on while
+	// the broker has flow-controlled this connection
+	blockedMu sync.Mutex
+	blocked   bool
+	unblocked *sync.Cond
+}
+
+// NewRabbitBroker dials rabbitAddress:rabbitPort with capped exponential
+// backoff, enables publisher confirms on the resulting channel, and starts
+// the supervisor goroutine that keeps the connection alive afterwards
+func NewRabbitBroker(rabbitAddress string, rabbitPort string, dlqName string, maxRedeliveries int64) (*RabbitBroker, error) {
+	broker := &RabbitBroker{
+		dlqName:         dlqName,
+		maxRedeliveries: maxRedeliveries,
+		url:             fmt.Sprintf("amqp://guest:guest@%s:%s/", rabbitAddress, rabbitPort),
+		stop:            make(chan struct{}),
+	}
+	broker.unblocked = sync.NewCond(&broker.blockedMu)
+
+	var err error
+	for i := 0; i < 6; i++ {
+		err = broker.dial()
+		if err == nil {
+			go broker.superviseConnection()
+			return broker, nil
+		}
+		time.Sleep(time.Duration(int64(math.Pow(2, float64(i)))) * time.Second)
+	}
+	return nil, err
+}
+
+func (broker *RabbitBroker) dial() error {
+	conn, err := amqp.Dial(broker.url)
+	if err != nil {
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	// prefetchCount 1 in QoS will load-balance messages between many instances of this service
+	err = channel.Qos(
+		1,     // prefetch count
+		0,     // prefetch size
+		false, // global
+	)
+	if err != nil {
+		return err
+	}
+	err = channel.Confirm(false)
+	if err != nil {
+		return err
+	}
+
+	broker.mu.Lock()
+	broker.conn = conn
+	broker.channel = channel
+	broker.mu.Unlock()
+	return nil
+}
+
+// superviseConnection watches the current connection for closure or
+// RabbitMQ flow-control and keeps the broker usable across both: a dropped
+// connection is redialed with capped, jittered backoff and its topology and
+// consumer are restored; a blocked connection just pauses Publish until the
+// broker reports it is unblocked again. It exits once Close closes
+// broker.stop, instead of treating the close Close() itself triggers as
+// another drop to reconnect from.
+func (broker *RabbitBroker) superviseConnection() {
+	for {
+		broker.mu.Lock()
+		conn := broker.conn
+		channel := broker.channel
+		broker.mu.Unlock()
+
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+		blocked := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+
+		for closed := false; !closed; {
+			select {
+			case b, ok := <-blocked:
+				if ok {
+					broker.setBlocked(b.Active)
+				}
+			case <-connClosed:
+				closed = true
+			case <-channelClosed:
+				closed = true
+			case <-broker.stop:
+				return
+			}
+		}
+
+		select {
+		case <-broker.stop:
+			return
+		default:
+		}
+
+		broker.reconnect()
+	}
+}
+
+// reconnect redials with capped exponential backoff and jitter, then
+// re-declares this broker's topology and resumes consuming, so a dropped
+// connection is invisible to ListenOrders/handleOrderMessage
+func (broker *RabbitBroker) reconnect() {
+	logger.Warn("AMQP connection lost, reconnecting...")
+	for attempt := 0; ; attempt++ {
+		if err := broker.dial(); err == nil {
+			break
+		} else {
+			logger.WithError(err).Warn("Could not redial AMQP broker, retrying")
+		}
+		backoff := time.Duration(math.Min(
+			float64(reconnectBaseDelay)*math.Pow(2, float64(attempt)),
+			float64(reconnectMaxBackoff),
+		))
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+	}
+	broker.setBlocked(false)
+
+	if broker.handler == nil {
+		return
+	}
+	if err := broker.declareTopology(); err != nil {
+		logger.WithError(err).Error("Could not redeclare topology after reconnect")
+		return
+	}
+	if err := broker.startConsuming(); err != nil {
+		logger.WithError(err).Error("Could not resume consuming after reconnect")
+		return
+	}
+	logger.Info("AMQP connection and topology restored")
+}
+
+// setBlocked records whether the broker currently has this connection under
+// flow control and wakes any Publish call waiting on it
+func (broker *RabbitBroker) setBlocked(isBlocked bool) {
+	broker.blockedMu.Lock()
+	broker.blocked = isBlocked
+	broker.blockedMu.Unlock()
+	if isBlocked {
+		logger.Warn("AMQP connection blocked by broker (flow control or memory alarm), pausing publishes")
+	} else {
+		broker.unblocked.Broadcast()
+	}
+}
+
+// waitUntilUnblocked blocks Publish while the broker has this connection
+// under flow control
+func (broker *RabbitBroker) waitUntilUnblocked() {
+	broker.blockedMu.Lock()
+	defer broker.blockedMu.Unlock()
+	for broker.blocked {
+		broker.unblocked.Wait()
+	}
+}
+
+// Subscribe declares a topic exchange, a durable queueName dead-letter-bound
+// to a matching DLQ, and starts delivering messages on it to handler
+func (broker *RabbitBroker) Subscribe(topic string, routingKey string, queueName string, handler Handler) error {
+	broker.topic = topic
+	broker.routingKey = routingKey
+	broker.queueName = queueName
+	broker.handler = handler
+
+	if err := broker.declareTopology(); err != nil {
+		return err
+	}
+	return broker.startConsuming()
+}
+
+// currentChannel returns the channel currently in use, guarding against a
+// concurrent redial swapping it out from under the caller
+func (broker *RabbitBroker) currentChannel() *amqp.Channel {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.channel
+}
+
+// declareTopology declares broker.topic's exchange, its dead-letter exchange
+// and queue, and the main queue bound to both. Called from Subscribe and
+// again by reconnect after every redial, since a fresh AMQP connection starts
+// with none of this topology in place.
+func (broker *RabbitBroker) declareTopology() error {
+	channel := broker.currentChannel()
+	err := channel.ExchangeDeclare(
+		broker.topic, // name
+		"topic",      // type
+		true,         // durable
+		false,        // auto-deleted
+		false,        // internal
+		false,        // no-wait
+		nil,          // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	dlxName := broker.topic + ".dlx"
+	err = channel.ExchangeDeclare(
+		dlxName,  // name
+		"direct", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		return err
+	}
+	dlq, err := channel.QueueDeclare(
+		broker.dlqName, // name
+		true,           // durable
+		false,          // delete when unused
+		false,          // exclusive
+		false,          // no-wait
+		nil,            // arguments
+	)
+	if err != nil {
+		return err
+	}
+	err = channel.QueueBind(
+		dlq.Name,       // queue name
+		broker.dlqName, // routing key
+		dlxName,        // exchange
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = channel.QueueDeclare(
+		broker.queueName, // name
+		true,             // durable
+		false,            // delete when unused
+		false,            // exclusive
+		false,            // no-wait
+		amqp.Table{ // arguments
+			"x-dead-letter-exchange":    dlxName,
+			"x-dead-letter-routing-key": broker.dlqName,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return channel.QueueBind(
+		broker.queueName,  // queue name
+		broker.routingKey, // routing key
+		broker.topic,      // exchange
+		false,
+		nil,
+	)
+}
+
+// startConsuming opens a fresh consumer on broker.queueName and dispatches
+// every delivery to broker.handler until the consumer is cancelled
+func (broker *RabbitBroker) startConsuming() error {
+	channel := broker.currentChannel()
+	deliveries, err := channel.Consume(
+		broker.queueName, // queue
+		consumerTag,      // consumer
+		false,            // auto-ack
+		false,            // exclusive
+		false,            // no-local
+		false,            // no-wait
+		nil,              // args
+	)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for delivery := range deliveries {
+			delivery := delivery
+			broker.handler(Message{
+				Body:    delivery.Body,
+				Headers: delivery.Headers,
+				Ack:     func() error { return delivery.Ack(false) },
+				Nack:    func() error { return broker.nackOrRetry(delivery) },
+			})
+		}
+	}()
+	return nil
+}
+
+// nackOrRetry rejects a delivery the handler couldn't process. If it has
+// been retried fewer than maxRedeliveries times, it is republished onto its
+// originating queue with retryCountHeader incremented and the original
+// delivery is acked off the queue; once maxRedeliveries is reached it is
+// nacked without requeue instead, so RabbitMQ dead-letters it onto the DLQ
+// via the x-dead-letter-exchange declareTopology configured on the queue.
+func (broker *RabbitBroker) nackOrRetry(delivery amqp.Delivery) error {
+	if retryCount(delivery) >= broker.maxRedeliveries {
+		return delivery.Nack(false, false)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = retryCount(delivery) + 1
+
+	err := broker.publishConfirmed(delivery.Exchange, delivery.RoutingKey, amqp.Publishing{
+		ContentType: delivery.ContentType,
+		Headers:     headers,
+		Body:        delivery.Body,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Could not republish message for retry, requeueing in place instead")
+		return delivery.Nack(false, true)
+	}
+	return delivery.Ack(false)
+}
+
+// Pause stops delivering messages by cancelling the consumer, without
+// unbinding the queue, so Resume can pick up exactly where it left off
+func (broker *RabbitBroker) Pause() error {
+	return broker.currentChannel().Cancel(consumerTag, false)
+}
+
+// Resume re-opens the consumer cancelled by Pause
+func (broker *RabbitBroker) Resume() error {
+	return broker.startConsuming()
+}
+
+// Publish sends payload to topic under routingKey and blocks until the
+// broker confirms it, or confirmTimeout elapses. It waits out any broker
+// flow-control block before publishing.
+func (broker *RabbitBroker) Publish(topic string, routingKey string, payload []byte) error {
+	broker.waitUntilUnblocked()
+
+	return broker.publishConfirmed(topic, routingKey, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        payload,
+	})
+}
+
+// publishConfirmed publishes msg and waits for the broker to settle that
+// exact publish, or confirmTimeout to elapse. It correlates the confirmation
+// to this publish via amqp091-go's deferred-confirm handle rather than
+// reading "whatever comes out next" off a channel-wide confirms stream,
+// which would risk attributing one caller's confirmation to another
+// concurrent publish on the same channel (the outbox publisher and
+// nackOrRetry's republish both publish here at the same time).
+func (broker *RabbitBroker) publishConfirmed(exchange string, routingKey string, msg amqp.Publishing) error {
+	channel := broker.currentChannel()
+	confirmation, err := channel.PublishWithDeferredConfirm(
+		exchange,
+		routingKey,
+		false, // mandatory
+		false, // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-confirmation.Done():
+		if !confirmation.Acked() {
+			return fmt.Errorf("broker nacked published message")
+		}
+		return nil
+	case <-time.After(confirmTimeout):
+		return fmt.Errorf("timed out waiting for broker to confirm published message")
+	}
+}
+
+// QueueDepth reports how many ready messages are currently sitting in
+// queueName, via the AMQP passive queue declare
+func (broker *RabbitBroker) QueueDepth(queueName string) (int, error) {
+	broker.mu.Lock()
+	channel := broker.channel
+	broker.mu.Unlock()
+
+	q, err := channel.QueueInspect(queueName)
+	if err != nil {
+		return 0, err
+	}
+	return q.Messages, nil
+}
+
+// Close tells superviseConnection to stop watching the connection, then
+// releases the underlying channel and connection
+func (broker *RabbitBroker) Close() error {
+	close(broker.stop)
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if err := broker.channel.Close(); err != nil {
+		return err
+	}
+	return broker.conn.Close()
+}
+
+// retryCount returns how many times this message has already been retried,
+// read from the retryCountHeader this broker stamps onto every republish
+func retryCount(delivery amqp.Delivery) int64 {
+	switch count := delivery.Headers[retryCountHeader].(type) {
+	case int64:
+		return count
+	case int32:
+		return int64(count)
+	default:
+		return 0
+	}
+}
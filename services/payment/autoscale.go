@@ -0,0 +1,86 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2021 Tobias Leonhard Joschka Peslalz
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package payment
+
+import (
+	"time"
+
+	"github.com/Tobias-Pe/Microservices-Errorhandling/pkg/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// queueDepthPollInterval is how often the queue backlog is sampled for
+// queueDepthGauge
+const queueDepthPollInterval = 10 * time.Second
+
+// These gauges/histogram are the signals KEDA's rabbitmq and prometheus
+// scalers need to treat this service as a first-class autoscaling target.
+var (
+	queueDepthGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_queue_depth",
+		Help: "Ready messages currently waiting in the payment order queue.",
+	})
+	// inflightGauge is a per-instance in-progress count, not the queue-wide
+	// MessagesUnacknowledged KEDA's rabbitmq scaler reads: the AMQP protocol
+	// only exposes messages ready for delivery via QueueDeclare's passive
+	// form (what queueDepthGauge already samples), not the unacked count,
+	// which RabbitMQ only surfaces through its HTTP management API. Useful
+	// for spotting a stuck handler, not for scaling decisions.
+	inflightGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_inflight_messages",
+		Help: "Order messages this instance has received but not yet acked or nacked. Per-instance only; not a queue-wide backlog signal, see payment_queue_depth for that.",
+	})
+	publishRateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_publish_rate",
+		Help: "Outbox rows published to the broker per second, sampled each outbox poll.",
+	})
+	processingLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_processing_latency_seconds",
+		Help:    "Time to handle a single order message, from delivery to ack/nack.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// pollQueueDepth periodically samples the broker's queue depth, if it
+// supports messaging.QueueInspector, and exposes it as queueDepthGauge
+func (service *Service) pollQueueDepth() {
+	inspector, ok := service.broker.(messaging.QueueInspector)
+	if !ok {
+		logger.Warn("Broker does not support queue inspection, payment_queue_depth will not be reported")
+		return
+	}
+
+	ticker := time.NewTicker(queueDepthPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		depth, err := inspector.QueueDepth(queueName)
+		if err != nil {
+			logger.WithError(err).Error("Could not sample queue depth")
+			continue
+		}
+		queueDepthGauge.Set(float64(depth))
+	}
+}
@@ -25,15 +25,29 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	loggingUtil "github.com/Tobias-Pe/Microservices-Errorhandling/pkg/log"
+	"github.com/Tobias-Pe/Microservices-Errorhandling/pkg/messaging"
 	"github.com/Tobias-Pe/Microservices-Errorhandling/services/payment"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	loggrus "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 type configuration struct {
-	rabbitAddress string
-	rabbitPort    string
+	messageBroker   string
+	rabbitAddress   string
+	rabbitPort      string
+	natsUrl         string
+	dlqName         string
+	maxRedeliveries int64
+	outboxDriver    string
+	outboxDsn       string
 }
 
 var logger = loggingUtil.InitLogger()
@@ -44,22 +58,37 @@ func main() {
 }
 
 func createServer(configuration configuration) {
-	service := payment.NewService(
-		configuration.rabbitAddress,
-		configuration.rabbitPort,
-	)
-
-	logger.Infof("Server listening...")
-	service.ListenOrders()
-
-	err := service.AmqpChannel.Close()
+	broker, err := newBroker(configuration)
 	if err != nil {
-		logger.WithError(err).Error("Error on closing amqp-channel")
+		logger.WithError(err).Error("Could not connect to message broker")
+		return
 	}
 
-	err = service.AmqpConn.Close()
+	service, err := payment.NewService(broker, configuration.outboxDriver, configuration.outboxDsn)
 	if err != nil {
-		logger.WithError(err).Error("Error on closing amqp-connection")
+		logger.WithError(err).Error("Could not open outbox store")
+		return
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	service.ListenOrders(stop)
+
+	if err := service.Close(); err != nil {
+		logger.WithError(err).Error("Error on closing broker connection")
+	}
+}
+
+// newBroker builds the messaging.Broker configured via MESSAGE_BROKER
+func newBroker(configuration configuration) (messaging.Broker, error) {
+	switch configuration.messageBroker {
+	case "nats":
+		return messaging.NewNatsBroker(configuration.natsUrl, configuration.dlqName, int(configuration.maxRedeliveries))
+	case "rabbitmq":
+		return messaging.NewRabbitBroker(configuration.rabbitAddress, configuration.rabbitPort, configuration.dlqName, configuration.maxRedeliveries)
+	default:
+		return nil, fmt.Errorf("unknown MESSAGE_BROKER %q", configuration.messageBroker)
 	}
 }
 
@@ -68,22 +97,45 @@ func readConfig() configuration {
 	viper.SetConfigName("local")
 	viper.AddConfigPath("./config")
 	viper.AutomaticEnv()
+	viper.SetDefault("MESSAGE_BROKER", "rabbitmq")
+	viper.SetDefault("PAYMENT_DLQ_NAME", "payment.dlq")
+	viper.SetDefault("PAYMENT_MAX_REDELIVERIES", 5)
+	viper.SetDefault("OUTBOX_DRIVER", "sqlite3")
+	viper.SetDefault("OUTBOX_DSN", "payment_outbox.db")
 
 	err := viper.ReadInConfig()
 	if err != nil {
 		logger.Info(err)
 	}
 
+	messageBroker := viper.GetString("MESSAGE_BROKER")
 	rabbitAddress := viper.GetString("RABBIT_MQ_ADDRESS")
 	rabbitPort := viper.GetString("RABBIT_MQ_PORT")
+	natsUrl := viper.GetString("NATS_URL")
+	dlqName := viper.GetString("PAYMENT_DLQ_NAME")
+	maxRedeliveries := viper.GetInt64("PAYMENT_MAX_REDELIVERIES")
+	outboxDriver := viper.GetString("OUTBOX_DRIVER")
+	outboxDsn := viper.GetString("OUTBOX_DSN")
 
 	logger.WithFields(loggrus.Fields{
-		"RABBIT_MQ_ADDRESS": rabbitAddress,
-		"RABBIT_MQ_PORT":    rabbitPort,
+		"MESSAGE_BROKER":           messageBroker,
+		"RABBIT_MQ_ADDRESS":        rabbitAddress,
+		"RABBIT_MQ_PORT":           rabbitPort,
+		"NATS_URL":                 natsUrl,
+		"PAYMENT_DLQ_NAME":         dlqName,
+		"PAYMENT_MAX_REDELIVERIES": maxRedeliveries,
+		"OUTBOX_DRIVER":            outboxDriver,
+		"OUTBOX_DSN":               outboxDsn,
 	}).Info("config variables read")
 
 	return configuration{
-		rabbitAddress: rabbitAddress,
-		rabbitPort:    rabbitPort,
+		messageBroker:   messageBroker,
+		rabbitAddress:   rabbitAddress,
+		rabbitPort:      rabbitPort,
+		natsUrl:         natsUrl,
+		dlqName:         dlqName,
+		maxRedeliveries: maxRedeliveries,
+		outboxDriver:    outboxDriver,
+		outboxDsn:       outboxDsn,
 	}
 }
@@ -0,0 +1,208 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2021 Tobias Leonhard Joschka Peslalz
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package payment
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	loggrus "github.com/sirupsen/logrus"
+)
+
+// outboxPollInterval is how often the outbox publisher looks for unsent rows
+const outboxPollInterval = 500 * time.Millisecond
+
+// outboxRow is a single unsent status update waiting to be published
+type outboxRow struct {
+	id         int64
+	orderId    string
+	topic      string
+	routingKey string
+	payload    []byte
+}
+
+// outboxStore is the transactional outbox backing a Service: every payment
+// decision is recorded atomically with the outbox row that will carry it to
+// the broker, so the two can never drift apart.
+type outboxStore struct {
+	db         *sql.DB
+	isPostgres bool
+}
+
+// newOutboxStore opens db (sqlite3 or postgres, picked by driverName) and
+// creates the outbox/payments tables if they don't exist yet
+func newOutboxStore(driverName string, dataSourceName string) (*outboxStore, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	store := &outboxStore{db: db, isPostgres: driverName == "postgres"}
+	if err := store.migrate(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *outboxStore) migrate() error {
+	if store.isPostgres {
+		_, err := store.db.Exec(`
+			CREATE TABLE IF NOT EXISTS payments (
+				id         SERIAL PRIMARY KEY,
+				order_id   TEXT NOT NULL,
+				allowed    BOOLEAN NOT NULL,
+				recorded_at TIMESTAMP NOT NULL
+			)`)
+		if err != nil {
+			return err
+		}
+		_, err = store.db.Exec(`
+			CREATE TABLE IF NOT EXISTS outbox_messages (
+				id          SERIAL PRIMARY KEY,
+				order_id    TEXT NOT NULL,
+				topic       TEXT NOT NULL,
+				routing_key TEXT NOT NULL,
+				payload     BYTEA NOT NULL,
+				sent        BOOLEAN NOT NULL DEFAULT FALSE,
+				created_at  TIMESTAMP NOT NULL
+			)`)
+		return err
+	}
+	_, err := store.db.Exec(`
+		CREATE TABLE IF NOT EXISTS payments (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id   TEXT NOT NULL,
+			allowed    BOOLEAN NOT NULL,
+			recorded_at TIMESTAMP NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec(`
+		CREATE TABLE IF NOT EXISTS outbox_messages (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id    TEXT NOT NULL,
+			topic       TEXT NOT NULL,
+			routing_key TEXT NOT NULL,
+			payload     BLOB NOT NULL,
+			sent        BOOLEAN NOT NULL DEFAULT 0,
+			created_at  TIMESTAMP NOT NULL
+		)`)
+	return err
+}
+
+// bindVar returns the i-th (1-based) positional placeholder for this store's
+// driver: "$1", "$2", ... for postgres, "?" everywhere else.
+func (store *outboxStore) bindVar(i int) string {
+	if store.isPostgres {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+// recordPayment writes the "payment recorded" row and the outbox row that
+// will carry its status update to the broker inside a single transaction,
+// so a crash between the two can never happen
+func (store *outboxStore) recordPayment(orderId string, allowed bool, topic string, routingKey string, payload []byte) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO payments (order_id, allowed, recorded_at) VALUES (%s, %s, %s)`,
+		store.bindVar(1), store.bindVar(2), store.bindVar(3)), orderId, allowed, now)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	sentLiteral := "0"
+	if store.isPostgres {
+		sentLiteral = "FALSE"
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO outbox_messages (order_id, topic, routing_key, payload, sent, created_at) VALUES (%s, %s, %s, %s, %s, %s)`,
+		store.bindVar(1), store.bindVar(2), store.bindVar(3), store.bindVar(4), sentLiteral, store.bindVar(5)),
+		orderId, topic, routingKey, payload, now)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// fetchPending returns outbox rows that haven't been published yet
+func (store *outboxStore) fetchPending() ([]outboxRow, error) {
+	rows, err := store.db.Query(`SELECT id, order_id, topic, routing_key, payload FROM outbox_messages WHERE sent = false ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.orderId, &row.topic, &row.routingKey, &row.payload); err != nil {
+			return nil, err
+		}
+		pending = append(pending, row)
+	}
+	return pending, rows.Err()
+}
+
+// markSent flags an outbox row as published so it isn't sent again
+func (store *outboxStore) markSent(id int64) error {
+	_, err := store.db.Exec(fmt.Sprintf(`UPDATE outbox_messages SET sent = true WHERE id = %s`, store.bindVar(1)), id)
+	return err
+}
+
+// publishOutbox polls the outbox and publishes every unsent row, marking it
+// sent only once the broker has confirmed it. Meant to run in its own
+// goroutine for the lifetime of the Service.
+func (service *Service) publishOutbox() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pending, err := service.outbox.fetchPending()
+		if err != nil {
+			logger.WithError(err).Error("Could not fetch pending outbox rows")
+			continue
+		}
+		var published int
+		for _, row := range pending {
+			err := service.broker.Publish(row.topic, row.routingKey, row.payload)
+			if err != nil {
+				logger.WithError(err).WithFields(loggrus.Fields{"order_id": row.orderId}).Error("Could not publish outbox row, will retry")
+				continue
+			}
+			if err := service.outbox.markSent(row.id); err != nil {
+				logger.WithError(err).WithFields(loggrus.Fields{"order_id": row.orderId}).Error("Could not mark outbox row as sent")
+			}
+			published++
+		}
+		publishRateGauge.Set(float64(published) / outboxPollInterval.Seconds())
+	}
+}
@@ -29,135 +29,86 @@ import (
 	"fmt"
 	"github.com/Tobias-Pe/Microservices-Errorhandling/api/requests"
 	loggingUtil "github.com/Tobias-Pe/Microservices-Errorhandling/pkg/log"
+	"github.com/Tobias-Pe/Microservices-Errorhandling/pkg/messaging"
 	"github.com/Tobias-Pe/Microservices-Errorhandling/pkg/metrics"
 	"github.com/Tobias-Pe/Microservices-Errorhandling/pkg/models"
 	loggrus "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
-	"math"
+	"github.com/sony/gobreaker"
 	"math/rand"
+	"os"
 	"strings"
 	"time"
 )
 
 const (
-	methodListenOrders = "PayOrder"
-	methodPublishOrder = "PublishOrder"
+	methodListenOrders   = "PayOrder"
+	methodPublishOrder   = "PublishOrder"
+	methodPaymentGateway = "PaymentGateway"
+	// gatewayMaxRetries is how many times a transient gateway failure is
+	// retried, with jittered exponential backoff, before giving up
+	gatewayMaxRetries = 3
+	// gatewayRetryBaseDelay is the starting delay for the backoff
+	gatewayRetryBaseDelay = 50 * time.Millisecond
+	// breakerResetTimeout is how long the circuit breaker stays open before
+	// allowing a trial request through in half-open state
+	breakerResetTimeout = 30 * time.Second
 )
 
+// errGatewayTimeout simulates a transient failure of the payment gateway,
+// the kind of error the circuit breaker and retry loop exist to absorb
+var errGatewayTimeout = fmt.Errorf("payment gateway timed out")
+
+// queueName is where order messages waiting for payment are held
+var queueName = "payment_" + requests.OrderTopic + "_queue"
+
 var logger = loggingUtil.InitLogger()
 
+// Service pays incoming orders and publishes their resulting status. It only
+// talks to messaging.Broker, so the concrete message-queue backend can be
+// swapped without touching this business logic.
 type Service struct {
-	AmqpChannel    *amqp.Channel
-	AmqpConn       *amqp.Connection
-	orderMessages  <-chan amqp.Delivery
-	rabbitUrl      string
+	broker         messaging.Broker
+	outbox         *outboxStore
+	breaker        *gobreaker.CircuitBreaker
 	requestsMetric *metrics.RequestsMetric
 }
 
-func NewService(rabbitAddress string, rabbitPort string) *Service {
-	service := &Service{}
-	service.rabbitUrl = fmt.Sprintf("amqp://guest:guest@%s:%s/", rabbitAddress, rabbitPort)
-	var err error = nil
-	// retry connecting to rabbitmq
-	for i := 0; i < 6; i++ {
-		err = service.initAmqpConnection()
-		if err == nil {
-			break
-		}
-		logger.Infof("Retrying... (%d/%d)", i, 5)
-		time.Sleep(time.Duration(int64(math.Pow(2, float64(i)))) * time.Second)
-	}
+// NewService wires up a Service around an already-connected broker and
+// outbox store, and starts the background goroutine that drains the outbox
+func NewService(broker messaging.Broker, outboxDriver string, outboxDsn string) (*Service, error) {
+	outbox, err := newOutboxStore(outboxDriver, outboxDsn)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-
-	err = service.createOrderListener()
-	if err != nil {
-		return nil
+	service := &Service{
+		broker:         broker,
+		outbox:         outbox,
+		requestsMetric: metrics.NewRequestsMetrics(),
 	}
-
-	service.requestsMetric = metrics.NewRequestsMetrics()
-
-	return service
+	service.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        methodPaymentGateway,
+		MaxRequests: 1,
+		Timeout:     breakerResetTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.Requests >= 10 && float64(counts.TotalFailures)/float64(counts.Requests) >= 0.5
+		},
+		OnStateChange: service.onBreakerStateChange,
+	})
+	go service.publishOutbox()
+	go service.pollQueueDepth()
+	return service, nil
 }
 
-func (service *Service) initAmqpConnection() error {
-	conn, err := amqp.Dial(service.rabbitUrl)
-	if err != nil {
-		return err
-	}
-	// connection and channel will be closed in main
-	service.AmqpConn = conn
-	service.AmqpChannel, err = conn.Channel()
-	if err != nil {
-		return err
-	}
-	// prefetchCount 1 in QoS will load-balance messages between many instances of this service
-	err = service.AmqpChannel.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
-	)
-	if err != nil {
-		return err
-	}
-	return nil
+// Close releases the underlying broker connection
+func (service *Service) Close() error {
+	return service.broker.Close()
 }
 
-// createOrderListener initialises exchange and queue and binds the queue to a topic and routing key to listen from
-func (service *Service) createOrderListener() error {
-	err := service.AmqpChannel.ExchangeDeclare(
-		requests.OrderTopic, // name
-		"topic",             // type
-		true,                // durable
-		false,               // auto-deleted
-		false,               // internal
-		false,               // no-wait
-		nil,                 // arguments
-	)
-	if err != nil {
-		return err
-	}
-	q, err := service.AmqpChannel.QueueDeclare(
-		"payment_"+requests.OrderTopic+"_queue", // name
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		return err
-	}
-	err = service.AmqpChannel.QueueBind(
-		q.Name,                  // queue name
-		requests.OrderStatusPay, // routing key
-		requests.OrderTopic,     // exchange
-		false,
-		nil,
-	)
-	if err != nil {
-		return err
-	}
-
-	// orderMessages will be where we get our order messages from
-	service.orderMessages, err = service.AmqpChannel.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// mockPayment simulates the paying process. Validates creditCart string and then sleeps random to simulate working
-func (service *Service) mockPayment(creditCard string) bool {
+// mockPayment simulates the paying process. Validates creditCart string, then
+// sleeps random to simulate working, and occasionally simulates the gateway
+// timing out so the retry and circuit-breaker logic around it has something
+// to exercise
+func (service *Service) mockPayment(creditCard string) (bool, error) {
 	creditCard = strings.ToLower(strings.TrimSpace(creditCard))
 	// simulate work: sleep for every char in creditCard randomly
 	for _, charVariable := range creditCard {
@@ -165,77 +116,136 @@ func (service *Service) mockPayment(creditCard string) bool {
 		time.Sleep(time.Duration(timeout) * time.Millisecond)
 		// validate for only numbers and special symbols
 		if charVariable >= 'a' && charVariable <= 'z' {
-			return false
+			return false, nil
 		}
 	}
-	return true
+	if rand.Intn(20) == 0 { // simulate an occasional transient gateway blip
+		return false, errGatewayTimeout
+	}
+	return true, nil
 }
 
-// mockPaymentRollback simulates undoing the payment process
-func (service *Service) mockPaymentRollback(creditCard string) {
-	creditCard = strings.ToLower(strings.TrimSpace(creditCard))
-	// simulate work: sleep for every char in creditCard randomly
-	for _, charVariable := range creditCard {
-		timeout := rand.Intn(5)
-		time.Sleep(time.Duration(timeout) * time.Millisecond)
-		if charVariable >= 'a' && charVariable <= 'z' {
-			return
+// payWithRetry calls mockPayment, retrying errGatewayTimeout with jittered
+// exponential backoff before giving up
+func (service *Service) payWithRetry(creditCard string) (bool, error) {
+	var lastErr error
+	for attempt := 0; attempt <= gatewayMaxRetries; attempt++ {
+		allowed, err := service.mockPayment(creditCard)
+		if err == nil {
+			return allowed, nil
 		}
+		lastErr = err
+		backoff := gatewayRetryBaseDelay * time.Duration(1<<attempt)
+		jitter := time.Duration(rand.Int63n(int64(backoff)))
+		time.Sleep(backoff + jitter)
 	}
+	return false, lastErr
 }
 
-// ListenOrders reads out order messages from bound amqp queue
-func (service *Service) ListenOrders() {
-	for message := range service.orderMessages {
-		order := &models.Order{}
-		err := json.Unmarshal(message.Body, order)
-		if err == nil {
-			isAllowed := service.mockPayment(order.CustomerCreditCard)
-			err = message.Ack(false)
-			service.requestsMetric.Increment(err, methodListenOrders)
-			if err != nil {
-				logger.WithError(err).Error("Could not ack message.")
-				if isAllowed { // ack could not be sent but transaction was successfully
-					logger.WithFields(loggrus.Fields{"request": *order}).WithError(err).Info("Rolling back transaction...")
-					// rollback transaction. because of the missing ack the current request will be resent
-					service.mockPaymentRollback(order.CustomerCreditCard)
-					logger.WithFields(loggrus.Fields{"request": *order}).Info("Rolling back successfully")
-				}
-			} else {
-				if !isAllowed { // abort order because of invalid payment data
-					logger.WithFields(loggrus.Fields{"payment_status": isAllowed, "request": *order}).Warn("Payment unsuccessfully. Aborting order...")
-					status := models.StatusAborted("We could not get the needed amount from your credit card. Please check your account.")
-					order.Status = status.Name
-					order.Message = status.Message
-				} else {
-					logger.WithFields(loggrus.Fields{"request": *order}).Infof("Order payed.")
-					status := models.StatusShipping()
-					order.Status = status.Name
-					order.Message = status.Message
-				}
-				// broadcast updated order
-				err = order.PublishOrderStatusUpdate(service.AmqpChannel)
-				if err != nil {
-					logger.WithFields(loggrus.Fields{"request": *order}).WithError(err).Error("Could not publish order update")
-				}
-				service.requestsMetric.Increment(err, methodPublishOrder)
-			}
-		} else {
-			logger.WithError(err).Error("Could not unmarshall message")
-			// ack message despite the error, or else we will get this message repeatedly
-			err = message.Ack(false)
-			if err != nil {
-				logger.WithError(err).Error("Could not ack message.")
+// onBreakerStateChange reports every circuit-breaker transition through the
+// requests metric, so an alert can be built on error-rate for
+// methodPaymentGateway, and pauses/resumes order consumption so a tripped
+// breaker actually relieves pressure on the gateway instead of piling up
+// redeliveries
+func (service *Service) onBreakerStateChange(_ string, from gobreaker.State, to gobreaker.State) {
+	logger.WithFields(loggrus.Fields{"from": from, "to": to}).Warn("Payment gateway circuit breaker changed state")
+	if to == gobreaker.StateOpen {
+		service.requestsMetric.Increment(fmt.Errorf("circuit breaker open"), methodPaymentGateway)
+		if err := service.broker.Pause(); err != nil {
+			logger.WithError(err).Error("Could not pause consuming while circuit breaker is open")
+		}
+		go func() {
+			time.Sleep(breakerResetTimeout)
+			if err := service.broker.Resume(); err != nil {
+				logger.WithError(err).Error("Could not resume consuming after circuit breaker reset timeout")
 			}
-			service.requestsMetric.Increment(err, methodListenOrders)
+		}()
+	} else {
+		service.requestsMetric.Increment(nil, methodPaymentGateway)
+	}
+}
+
+// ListenOrders subscribes to incoming order messages, handling each one as
+// it arrives, until stop is signalled
+func (service *Service) ListenOrders(stop <-chan os.Signal) {
+	err := service.broker.Subscribe(requests.OrderTopic, requests.OrderStatusPay, queueName, service.handleOrderMessage)
+	if err != nil {
+		logger.WithError(err).Error("Could not start listening for orders")
+		return
+	}
+	logger.Infof("Server listening...")
+	<-stop
+	logger.Info("Shutdown signal received, stopping order consumption")
+}
+
+// handleOrderMessage pays a single order and durably records its resulting
+// status in the transactional outbox, only acking the inbound message once
+// that record is committed. The outbox publisher then delivers it to the
+// broker independently, so a crash between paying and publishing can no
+// longer drop the status transition or leave it half-applied.
+func (service *Service) handleOrderMessage(message messaging.Message) {
+	inflightGauge.Inc()
+	start := time.Now()
+	defer func() {
+		inflightGauge.Dec()
+		processingLatency.Observe(time.Since(start).Seconds())
+	}()
+
+	order := &models.Order{}
+	err := json.Unmarshal(message.Body, order)
+	if err != nil {
+		logger.WithError(err).Error("Could not unmarshall message")
+		// reject instead of acking, so repeat offenders eventually land in the DLQ
+		if nackErr := message.Nack(); nackErr != nil {
+			logger.WithError(nackErr).Error("Could not nack message.")
 		}
+		service.requestsMetric.Increment(err, methodListenOrders)
+		return
 	}
-	logger.Warn("Stopped Listening for Orders! Restarting...")
-	// try reconnecting
-	err := service.createOrderListener()
+
+	result, err := service.breaker.Execute(func() (interface{}, error) {
+		return service.payWithRetry(order.CustomerCreditCard)
+	})
 	if err != nil {
-		logger.WithError(err).Error("Stopped Listening for Orders! Could not restart")
+		logger.WithFields(loggrus.Fields{"request": *order}).WithError(err).Error("Payment gateway unavailable")
+		if nackErr := message.Nack(); nackErr != nil {
+			logger.WithError(nackErr).Error("Could not nack message.")
+		}
+		service.requestsMetric.Increment(err, methodListenOrders)
+		return
+	}
+	isAllowed := result.(bool)
+	if !isAllowed { // abort order because of invalid payment data
+		logger.WithFields(loggrus.Fields{"payment_status": isAllowed, "request": *order}).Warn("Payment unsuccessfully. Aborting order...")
+		status := models.StatusAborted("We could not get the needed amount from your credit card. Please check your account.")
+		order.Status = status.Name
+		order.Message = status.Message
 	} else {
-		service.ListenOrders()
+		logger.WithFields(loggrus.Fields{"request": *order}).Infof("Order payed.")
+		status := models.StatusShipping()
+		order.Status = status.Name
+		order.Message = status.Message
+	}
+
+	// record the payment decision and its outbound status update in one
+	// transaction; the outbox publisher delivers it to the broker later
+	payload, err := json.Marshal(order)
+	if err == nil {
+		err = service.outbox.recordPayment(order.ID, isAllowed, requests.OrderTopic, order.Status, payload)
+	}
+	service.requestsMetric.Increment(err, methodPublishOrder)
+	if err != nil {
+		logger.WithFields(loggrus.Fields{"request": *order}).WithError(err).Error("Could not record order update in outbox")
+		if nackErr := message.Nack(); nackErr != nil {
+			logger.WithError(nackErr).Error("Could not nack message.")
+		}
+		service.requestsMetric.Increment(err, methodListenOrders)
+		return
+	}
+
+	err = message.Ack()
+	if err != nil {
+		logger.WithError(err).Error("Could not ack message.")
 	}
+	service.requestsMetric.Increment(err, methodListenOrders)
 }